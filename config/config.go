@@ -0,0 +1,103 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the top-level blackbox_exporter configuration: a set of
+// named probe modules, keyed by the name scrape targets select via the
+// `module` URL parameter.
+type Config struct {
+	Modules map[string]Module `yaml:"modules"`
+}
+
+// SafeConfig wraps Config with a mutex so the HTTP handler can reload it
+// from disk without racing in-flight probes.
+type SafeConfig struct {
+	sync.RWMutex
+	C *Config
+}
+
+// ReloadConfig re-reads and re-parses confFile, replacing C only once
+// the new configuration has parsed cleanly.
+func (sc *SafeConfig) ReloadConfig(confFile string) error {
+	var c = &Config{}
+
+	yamlFile, err := ioutil.ReadFile(confFile)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %s", err)
+	}
+	if err := yaml.Unmarshal(yamlFile, c); err != nil {
+		return fmt.Errorf("error parsing config file: %s", err)
+	}
+
+	sc.Lock()
+	sc.C = c
+	sc.Unlock()
+	return nil
+}
+
+// Module is one probe configuration, selected by the `prober` field and
+// scoped to the corresponding XxxProbe struct below.
+type Module struct {
+	Prober     string          `yaml:"prober,omitempty"`
+	Timeout    model.Duration  `yaml:"timeout,omitempty"`
+	ICMP       ICMPProbe       `yaml:"icmp,omitempty"`
+	Traceroute TracerouteProbe `yaml:"traceroute,omitempty"`
+}
+
+// ICMPProbe configures prober.ProbeICMP.
+type ICMPProbe struct {
+	PreferredIPProtocol string `yaml:"preferred_ip_protocol,omitempty"`
+
+	// Count is the number of echo requests sent per scrape, defaulted to
+	// 1 in ProbeICMP when zero; Interval is the delay between them, and
+	// a zero Interval sends them back to back.
+	Count    int            `yaml:"count,omitempty"`
+	Interval model.Duration `yaml:"interval,omitempty"`
+
+	// Privileged selects a raw ip4:icmp/ip6:ipv6-icmp socket (the
+	// historical behavior, requiring CAP_NET_RAW) when true or absent,
+	// or an unprivileged udp4/udp6 datagram socket when explicitly set
+	// to false.
+	Privileged *bool `yaml:"privileged,omitempty"`
+
+	// DontFragment sets the IP don't-fragment bit, so a path MTU
+	// black-hole surfaces as a probe failure (probe_icmp_dontfragment_exceeded)
+	// rather than being silently masked by fragmentation.
+	DontFragment bool `yaml:"dont_fragment,omitempty"`
+
+	// PayloadSize and PayloadPattern control the echo request body.
+	// PayloadPattern is interpreted as hex if it decodes cleanly,
+	// otherwise as a literal string; either way it's repeated/truncated
+	// to fill PayloadSize bytes.
+	PayloadSize    int    `yaml:"payload_size,omitempty"`
+	PayloadPattern string `yaml:"payload_pattern,omitempty"`
+}
+
+// TracerouteProbe configures prober.ProbeTraceroute.
+type TracerouteProbe struct {
+	PreferredIPProtocol string `yaml:"preferred_ip_protocol,omitempty"`
+
+	// MaxHops bounds how far the TTL/HopLimit search climbs looking for
+	// the target. Defaulted in ProbeTraceroute when zero.
+	MaxHops int `yaml:"max_hops,omitempty"`
+}
@@ -0,0 +1,93 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// icmpConn is a raw ip4:icmp/ip6:ipv6-icmp or unprivileged udp4/udp6
+// ICMP socket. It's built directly on net.ListenPacket rather than
+// golang.org/x/net/icmp.PacketConn because that type never exposes the
+// underlying net.PacketConn (or its file descriptor), so there's no way
+// to reach the socket options setDontFragment needs; constructing the
+// connection ourselves keeps SyscallConn available.
+type icmpConn struct {
+	pc  net.PacketConn
+	ip4 *ipv4.PacketConn
+	ip6 *ipv6.PacketConn
+}
+
+// listenICMP opens network ("ip4:icmp", "udp4", "ip6:ipv6-icmp" or
+// "udp6") bound to the wildcard address for the given IP version.
+func listenICMP(network string, v6 bool) (*icmpConn, error) {
+	addr := "0.0.0.0"
+	if v6 {
+		addr = "::"
+	}
+	pc, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &icmpConn{pc: pc}
+	if v6 {
+		c.ip6 = ipv6.NewPacketConn(pc)
+	} else {
+		c.ip4 = ipv4.NewPacketConn(pc)
+	}
+	return c, nil
+}
+
+func (c *icmpConn) IPv4PacketConn() *ipv4.PacketConn { return c.ip4 }
+func (c *icmpConn) IPv6PacketConn() *ipv6.PacketConn { return c.ip6 }
+
+func (c *icmpConn) WriteTo(b []byte, addr net.Addr) (int, error) { return c.pc.WriteTo(b, addr) }
+func (c *icmpConn) ReadFrom(b []byte) (int, net.Addr, error)     { return c.pc.ReadFrom(b) }
+func (c *icmpConn) Close() error                                 { return c.pc.Close() }
+func (c *icmpConn) SetReadDeadline(t time.Time) error            { return c.pc.SetReadDeadline(t) }
+
+// SyscallConn exposes the socket's file descriptor for the setsockopt
+// calls in setDontFragment. Raw ip4:icmp/ip6:ipv6-icmp and udp4/udp6
+// sockets are always backed by *net.IPConn/*net.UDPConn, both of which
+// implement syscall.Conn.
+func (c *icmpConn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := c.pc.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("prober: %T does not support SyscallConn", c.pc)
+	}
+	return sc.SyscallConn()
+}
+
+// packetTooBigMTU reports whether rm is a fragmentation-needed reply
+// (ICMPv4 destination-unreachable/frag-needed, or ICMPv6 packet-too-big)
+// and, if so, the MTU reported in it. For ICMPv4 the returned MTU is
+// always 0: the next-hop MTU field of a frag-needed reply is not read.
+func packetTooBigMTU(rm *icmp.Message) (mtu int, ok bool) {
+	switch body := rm.Body.(type) {
+	case *icmp.PacketTooBig:
+		return body.MTU, true
+	case *icmp.DstUnreach:
+		if rm.Type == ipv4.ICMPTypeDestinationUnreachable && rm.Code == 4 { // fragmentation needed and DF set
+			return 0, true
+		}
+	}
+	return 0, false
+}
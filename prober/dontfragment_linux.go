@@ -0,0 +1,66 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package prober
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setDontFragment sets IP_MTU_DISCOVER/IPV6_MTU_DISCOVER to "probe" mode,
+// which both asks the kernel to set the don't-fragment bit and surfaces
+// EMSGSIZE locally instead of silently fragmenting.
+func setDontFragment(conn *icmpConn, v6 bool) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	ctrlErr := rc.Control(func(fd uintptr) {
+		if v6 {
+			sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_PROBE)
+		} else {
+			sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_PROBE)
+		}
+	})
+	if ctrlErr != nil {
+		return ctrlErr
+	}
+	return sockErr
+}
+
+// isMessageTooLong reports whether err indicates the kernel rejected an
+// outgoing don't-fragment packet as too large for the path MTU.
+func isMessageTooLong(err error) bool {
+	return isErrno(err, unix.EMSGSIZE)
+}
+
+func isErrno(err error, errno syscall.Errno) bool {
+	for err != nil {
+		if syscallErr, ok := err.(syscall.Errno); ok {
+			return syscallErr == errno
+		}
+		unwrapper, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return false
+		}
+		err = unwrapper.Unwrap()
+	}
+	return false
+}
@@ -0,0 +1,31 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package prober
+
+import "errors"
+
+// setDontFragment is unsupported on this platform: there is no portable
+// socket option to request it through the standard library or x/net.
+func setDontFragment(conn *icmpConn, v6 bool) error {
+	return errors.New("setting the don't-fragment bit is not supported on this platform")
+}
+
+// isMessageTooLong is conservative on platforms where we can't
+// distinguish a DF-triggered rejection from other write errors.
+func isMessageTooLong(err error) bool {
+	return false
+}
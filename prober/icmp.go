@@ -14,11 +14,13 @@
 package prober
 
 import (
-	"bytes"
 	"context"
+	"encoding/hex"
+	"fmt"
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -43,12 +45,256 @@ func getICMPSequence() uint16 {
 	return icmpSequence
 }
 
+// icmpReply is a single echo reply, matched back to the request that
+// produced it.
+type icmpReply struct {
+	hopLimit int
+}
+
+// icmpPendingKey correlates an inbound reply to the probe that's
+// waiting for it. Keying on the peer address as well as the sequence
+// number - rather than the wire sequence number alone - means two
+// concurrent probes to different targets can't collide even though the
+// process-wide sequence counter is only 16 bits and wraps constantly at
+// the "thousands of targets" scale this listener is meant to support.
+type icmpPendingKey struct {
+	peer string
+	seq  int
+}
+
+// peerIP extracts the bare IP text of a net.Addr, regardless of
+// whether it's a *net.IPAddr (raw ip4:icmp/ip6:ipv6-icmp sockets) or a
+// *net.UDPAddr (unprivileged udp4/udp6 sockets), so the same target
+// produces the same pending-map key no matter which socket type served
+// the reply.
+func peerIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.IPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	default:
+		return addr.String()
+	}
+}
+
+// icmpPending is what's registered for a given key: the channel to
+// deliver the reply on, plus enough of the original request to validate
+// an inbound packet before dispatching it.
+type icmpPending struct {
+	ch         chan icmpReply
+	id         int
+	privileged bool
+}
+
+// icmpListener owns one shared ICMP socket and a background goroutine
+// demultiplexing replies to in-flight probes, so ProbeICMP doesn't pay
+// the cost of opening and closing a socket on every scrape and doesn't
+// lose replies to concurrent probes racing on the same socket.
+type icmpListener struct {
+	conn      *icmpConn
+	v6        bool
+	replyType icmp.Type
+
+	mu      sync.Mutex
+	pending map[icmpPendingKey]icmpPending
+
+	// mtuExceeded is set when a PacketTooBig/fragmentation-needed reply
+	// arrives; it's process-wide per listener rather than per-probe,
+	// since the quoted original packet would need to be unpacked to
+	// recover which in-flight probe it belongs to.
+	mtuExceeded int32
+}
+
+var (
+	icmpListeners   = map[string]*icmpListener{}
+	icmpListenersMu sync.Mutex
+)
+
+// icmpListenerKey identifies a listener by the network it listens on
+// and whether it was created with the don't-fragment bit set. DF is a
+// socket-wide option set once at creation time, so a module asking for
+// DontFragment must not be handed - and must not mutate - the plain
+// listener that every other module on the same network shares; it gets
+// its own singleton instead.
+func icmpListenerKey(network string, dontFragment bool) string {
+	return fmt.Sprintf("%s|df=%t", network, dontFragment)
+}
+
+// getICMPListener returns the shared listener for network ("ip4:icmp",
+// "udp4", "ip6:ipv6-icmp" or "udp6") and don't-fragment setting,
+// creating and starting it on first use.
+func getICMPListener(network string, v6, dontFragment bool) (*icmpListener, error) {
+	icmpListenersMu.Lock()
+	defer icmpListenersMu.Unlock()
+
+	key := icmpListenerKey(network, dontFragment)
+	if l, ok := icmpListeners[key]; ok {
+		return l, nil
+	}
+
+	conn, err := listenICMP(network, v6)
+	if err != nil {
+		return nil, err
+	}
+	if v6 {
+		_ = conn.IPv6PacketConn().SetControlMessage(ipv6.FlagHopLimit, true)
+	} else {
+		_ = conn.IPv4PacketConn().SetControlMessage(ipv4.FlagTTL, true)
+	}
+	if dontFragment {
+		if err := setDontFragment(conn, v6); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	replyType := icmp.Type(ipv4.ICMPTypeEchoReply)
+	if v6 {
+		replyType = ipv6.ICMPTypeEchoReply
+	}
+
+	l := &icmpListener{
+		conn:      conn,
+		v6:        v6,
+		replyType: replyType,
+		pending:   map[icmpPendingKey]icmpPending{},
+	}
+	go l.serve()
+	icmpListeners[key] = l
+	return l, nil
+}
+
+// register adds a channel awaiting the reply from peer with the given
+// id/seq. The caller must call unregister once it stops waiting,
+// whether or not a reply arrived.
+func (l *icmpListener) register(peer net.Addr, id, seq int, privileged bool) chan icmpReply {
+	ch := make(chan icmpReply, 1)
+	l.mu.Lock()
+	l.pending[icmpPendingKey{peer: peerIP(peer), seq: seq}] = icmpPending{ch: ch, id: id, privileged: privileged}
+	l.mu.Unlock()
+	return ch
+}
+
+func (l *icmpListener) unregister(peer net.Addr, seq int) {
+	l.mu.Lock()
+	delete(l.pending, icmpPendingKey{peer: peerIP(peer), seq: seq})
+	l.mu.Unlock()
+}
+
+// serve reads packets off the shared socket for the lifetime of the
+// process, dispatching echo replies to whichever probe is waiting on
+// their (peer, sequence) and discarding everything else, including
+// replies from hosts this listener never probed and messages that
+// aren't the echo reply this listener expects.
+func (l *icmpListener) serve() {
+	proto := protocolICMP
+	if l.v6 {
+		proto = protocolIPv6ICMP
+	}
+
+	rb := make([]byte, 1500)
+	for {
+		var (
+			n        int
+			peer     net.Addr
+			hopLimit int
+			err      error
+		)
+		if l.v6 {
+			var cm *ipv6.ControlMessage
+			n, cm, peer, err = l.conn.IPv6PacketConn().ReadFrom(rb)
+			if cm != nil {
+				hopLimit = cm.HopLimit
+			}
+		} else {
+			var cm *ipv4.ControlMessage
+			n, cm, peer, err = l.conn.IPv4PacketConn().ReadFrom(rb)
+			if cm != nil {
+				hopLimit = cm.TTL
+			}
+		}
+		if err != nil {
+			// The shared socket was closed (process shutting down) or hit
+			// an unrecoverable error; nothing left to dispatch.
+			return
+		}
+
+		rm, err := icmp.ParseMessage(proto, rb[:n])
+		if err != nil {
+			continue
+		}
+		l.dispatch(rm, peer, hopLimit)
+	}
+}
+
+// dispatch delivers rm, received from peer with the given hop limit, to
+// whichever probe's pending channel matches it, discarding anything
+// addressed to nobody. It's the synchronous core of serve(), split out
+// so the demultiplexing logic can be exercised directly in tests without
+// a live socket.
+func (l *icmpListener) dispatch(rm *icmp.Message, peer net.Addr, hopLimit int) {
+	if _, isTooBig := packetTooBigMTU(rm); isTooBig {
+		atomic.StoreInt32(&l.mtuExceeded, 1)
+		return
+	}
+	if rm.Type != l.replyType {
+		return
+	}
+	echo, ok := rm.Body.(*icmp.Echo)
+	if !ok {
+		return
+	}
+
+	l.mu.Lock()
+	p, waiting := l.pending[icmpPendingKey{peer: peerIP(peer), seq: echo.Seq}]
+	l.mu.Unlock()
+	if !waiting {
+		return
+	}
+	if p.privileged && echo.ID != p.id {
+		return
+	}
+
+	select {
+	case p.ch <- icmpReply{hopLimit: hopLimit}:
+	default:
+		// Probe already gave up on this sequence number; drop it.
+	}
+}
+
 func ProbeICMP(ctx context.Context, target string, module config.Module, registry *prometheus.Registry, logger log.Logger) (success bool) {
 	var (
-		socket      *icmp.PacketConn
 		requestType icmp.Type
-		replyType   icmp.Type
+
+		rttSeconds = prometheus.NewSummary(prometheus.SummaryOpts{
+			Name:       "probe_icmp_rtt_seconds",
+			Help:       "Round-trip time of each ICMP echo reply",
+			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+		})
+		hopLimitGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_icmp_reply_hop_limit",
+			Help: "Replied packet hop limit (TTL)",
+		})
+		packetsTransmitted = prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "probe_icmp_packets_transmitted",
+			Help: "Number of ICMP echo requests transmitted",
+		})
+		packetsReceived = prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "probe_icmp_packets_received",
+			Help: "Number of ICMP echo replies received",
+		})
+		dontFragmentExceeded = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_icmp_dontfragment_exceeded",
+			Help: "Whether the don't-fragment packet exceeded the path MTU",
+		})
 	)
+	registry.MustRegister(rttSeconds)
+	registry.MustRegister(hopLimitGauge)
+	registry.MustRegister(packetsTransmitted)
+	registry.MustRegister(packetsReceived)
+	registry.MustRegister(dontFragmentExceeded)
+
 	timeoutDeadline, _ := ctx.Deadline()
 	deadline := time.Now().Add(timeoutDeadline.Sub(time.Now()))
 
@@ -58,81 +304,147 @@ func ProbeICMP(ctx context.Context, target string, module config.Module, registr
 		return false
 	}
 
-	level.Info(logger).Log("msg", "Creating socket")
-	if ip.IP.To4() == nil {
+	privileged := module.ICMP.Privileged == nil || *module.ICMP.Privileged
+	v6 := ip.IP.To4() == nil
+
+	var network string
+	switch {
+	case v6 && privileged:
+		network = "ip6:ipv6-icmp"
 		requestType = ipv6.ICMPTypeEchoRequest
-		replyType = ipv6.ICMPTypeEchoReply
-		socket, err = icmp.ListenPacket("ip6:ipv6-icmp", "::")
-	} else {
+	case v6 && !privileged:
+		network = "udp6"
+		requestType = ipv6.ICMPTypeEchoRequest
+	case !v6 && privileged:
+		network = "ip4:icmp"
+		requestType = ipv4.ICMPTypeEcho
+	default:
+		network = "udp4"
 		requestType = ipv4.ICMPTypeEcho
-		replyType = ipv4.ICMPTypeEchoReply
-		socket, err = icmp.ListenPacket("ip4:icmp", "0.0.0.0")
 	}
 
+	level.Info(logger).Log("msg", "Using shared ICMP listener", "network", network, "dont_fragment", module.ICMP.DontFragment)
+	listener, err := getICMPListener(network, v6, module.ICMP.DontFragment)
 	if err != nil {
 		level.Error(logger).Log("msg", "Error listening to socket", "err", err)
 		return
 	}
-	defer socket.Close()
 
-	body := &icmp.Echo{
-		ID:   os.Getpid() & 0xffff,
-		Seq:  int(getICMPSequence()),
-		Data: []byte("Prometheus Blackbox Exporter"),
-	}
-	level.Info(logger).Log("msg", "Creating ICMP packet", "seq", body.Seq, "id", body.ID)
-	wm := icmp.Message{
-		Type: requestType,
-		Code: 0,
-		Body: body,
+	count := module.ICMP.Count
+	if count < 1 {
+		count = 1
 	}
+	interval := time.Duration(module.ICMP.Interval)
+	payload := icmpPayload(module.ICMP.PayloadSize, module.ICMP.PayloadPattern)
 
-	wb, err := wm.Marshal(nil)
-	if err != nil {
-		level.Error(logger).Log("msg", "Error marshalling packet", "err", err)
-		return
-	}
-	level.Info(logger).Log("msg", "Writing out packet")
-	if _, err = socket.WriteTo(wb, ip); err != nil {
-		level.Warn(logger).Log("msg", "Error writing to socket", "err", err)
-		return
-	}
+	id := os.Getpid() & 0xffff
+	var replies int
 
-	// Reply should be the same except for the message type.
-	wm.Type = replyType
-	wb, err = wm.Marshal(nil)
-	if err != nil {
-		level.Error(logger).Log("msg", "Error marshalling packet", "err", err)
-		return
-	}
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil || !time.Now().Before(deadline) {
+			break
+		}
 
-	rb := make([]byte, 1500)
-	if err := socket.SetReadDeadline(deadline); err != nil {
-		level.Error(logger).Log("msg", "Error setting socket deadline", "err", err)
-		return
-	}
-	level.Info(logger).Log("msg", "Waiting for reply packets")
-	for {
-		n, peer, err := socket.ReadFrom(rb)
+		seq := int(getICMPSequence())
+		wm := icmp.Message{
+			Type: requestType,
+			Code: 0,
+			Body: &icmp.Echo{ID: id, Seq: seq, Data: payload},
+		}
+		level.Info(logger).Log("msg", "Creating ICMP packet", "seq", seq, "id", id)
+
+		wb, err := wm.Marshal(nil)
 		if err != nil {
-			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
-				level.Warn(logger).Log("msg", "Timeout reading from socket", "err", err)
-				return
-			}
-			level.Error(logger).Log("msg", "Error reading from socket", "err", err)
-			continue
+			level.Error(logger).Log("msg", "Error marshalling packet", "err", err)
+			return
 		}
-		if peer.String() != ip.String() {
+
+		replyCh := listener.register(ip, id, seq, privileged)
+		level.Info(logger).Log("msg", "Writing out packet")
+		sent := time.Now()
+		if _, err = listener.conn.WriteTo(wb, ip); err != nil {
+			if module.ICMP.DontFragment && isMessageTooLong(err) {
+				level.Warn(logger).Log("msg", "Packet exceeded path MTU with don't-fragment set", "err", err)
+				dontFragmentExceeded.Set(1)
+			}
+			level.Warn(logger).Log("msg", "Error writing to socket", "err", err)
+			listener.unregister(ip, seq)
 			continue
 		}
-		if replyType == ipv6.ICMPTypeEchoReply {
-			// Clear checksum to make comparison succeed.
-			rb[2] = 0
-			rb[3] = 0
+		packetsTransmitted.Inc()
+
+		reply, ok := awaitICMPReply(ctx, replyCh, deadline, logger)
+		listener.unregister(ip, seq)
+		if module.ICMP.DontFragment && atomic.CompareAndSwapInt32(&listener.mtuExceeded, 1, 0) {
+			level.Warn(logger).Log("msg", "Packet too big reply received with don't-fragment set")
+			dontFragmentExceeded.Set(1)
 		}
-		if bytes.Compare(rb[:n], wb) == 0 {
-			level.Info(logger).Log("msg", "Found matching reply packet")
-			return true
+		if !ok {
+			continue
 		}
+		replies++
+		packetsReceived.Inc()
+		rttSeconds.Observe(time.Since(sent).Seconds())
+		hopLimitGauge.Set(float64(reply.hopLimit))
+	}
+
+	return replies > 0
+}
+
+// awaitICMPReply blocks until a reply arrives on replyCh, the scrape
+// deadline passes, or the context is cancelled.
+func awaitICMPReply(ctx context.Context, replyCh chan icmpReply, deadline time.Time, logger log.Logger) (icmpReply, bool) {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	level.Info(logger).Log("msg", "Waiting for reply packet")
+	select {
+	case reply := <-replyCh:
+		level.Info(logger).Log("msg", "Found matching reply packet")
+		return reply, true
+	case <-timer.C:
+		level.Warn(logger).Log("msg", "Timeout waiting for reply")
+		return icmpReply{}, false
+	case <-ctx.Done():
+		return icmpReply{}, false
+	}
+}
+
+const (
+	protocolICMP     = 1
+	protocolIPv6ICMP = 58
+)
+
+// icmpPayload returns the bytes to send as the echo request body. With no
+// size or pattern configured it falls back to the historical fixed
+// payload. PayloadPattern is interpreted as hex if it decodes cleanly,
+// otherwise as a literal string; either way it's repeated/truncated to
+// fill PayloadSize.
+func icmpPayload(size int, pattern string) []byte {
+	if size <= 0 && pattern == "" {
+		return []byte("Prometheus Blackbox Exporter")
+	}
+
+	fill := []byte(pattern)
+	if decoded, err := hex.DecodeString(pattern); err == nil && len(pattern) > 0 {
+		fill = decoded
+	}
+	if len(fill) == 0 {
+		fill = []byte{0}
+	}
+	if size <= 0 {
+		size = len(fill)
+	}
+
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = fill[i%len(fill)]
 	}
+	return data
 }
@@ -0,0 +1,148 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+func TestICMPPayloadDefault(t *testing.T) {
+	got := icmpPayload(0, "")
+	want := []byte("Prometheus Blackbox Exporter")
+	if !bytes.Equal(got, want) {
+		t.Errorf("icmpPayload(0, \"\") = %q, want %q", got, want)
+	}
+}
+
+func TestICMPPayloadHexPattern(t *testing.T) {
+	// "deadbeef" decodes cleanly as hex, so it should be used as raw
+	// bytes rather than the literal ASCII string.
+	got := icmpPayload(6, "deadbeef")
+	want := []byte{0xde, 0xad, 0xbe, 0xef, 0xde, 0xad}
+	if !bytes.Equal(got, want) {
+		t.Errorf("icmpPayload(6, \"deadbeef\") = % x, want % x", got, want)
+	}
+}
+
+func TestICMPPayloadLiteralPattern(t *testing.T) {
+	// "xy" doesn't decode as hex, so it's used as a literal string and
+	// repeated to fill the requested size.
+	got := icmpPayload(5, "xy")
+	want := []byte("xyxyx")
+	if !bytes.Equal(got, want) {
+		t.Errorf("icmpPayload(5, \"xy\") = %q, want %q", got, want)
+	}
+}
+
+func TestICMPPayloadPatternNoSize(t *testing.T) {
+	// With no explicit size, the pattern's own decoded length is used.
+	got := icmpPayload(0, "ab")
+	want := []byte{0xab}
+	if !bytes.Equal(got, want) {
+		t.Errorf("icmpPayload(0, \"ab\") = % x, want % x", got, want)
+	}
+}
+
+func TestICMPPayloadSizeNoPattern(t *testing.T) {
+	got := icmpPayload(4, "")
+	want := []byte{0, 0, 0, 0}
+	if !bytes.Equal(got, want) {
+		t.Errorf("icmpPayload(4, \"\") = % x, want % x", got, want)
+	}
+}
+
+func TestICMPListenerDispatchPerPeer(t *testing.T) {
+	l := &icmpListener{
+		replyType: ipv4.ICMPTypeEchoReply,
+		pending:   map[icmpPendingKey]icmpPending{},
+	}
+
+	peerA := &net.IPAddr{IP: net.ParseIP("192.0.2.1")}
+	peerB := &net.IPAddr{IP: net.ParseIP("192.0.2.2")}
+
+	chA := l.register(peerA, 1, 7, true)
+	chB := l.register(peerB, 2, 7, true)
+
+	replyFrom := func(peer net.Addr, id int) *icmp.Message {
+		return &icmp.Message{
+			Type: ipv4.ICMPTypeEchoReply,
+			Code: 0,
+			Body: &icmp.Echo{ID: id, Seq: 7},
+		}
+	}
+
+	l.dispatch(replyFrom(peerA, 1), peerA, 64)
+	l.dispatch(replyFrom(peerB, 2), peerB, 55)
+
+	select {
+	case <-chA:
+	default:
+		t.Error("peer A never received its reply")
+	}
+	select {
+	case r := <-chB:
+		if r.hopLimit != 55 {
+			t.Errorf("peer B reply hopLimit = %d, want 55", r.hopLimit)
+		}
+	default:
+		t.Error("peer B never received its reply")
+	}
+
+	// Peer A's channel must not also have received peer B's reply.
+	select {
+	case <-chA:
+		t.Error("peer A received a second reply; it should only have gotten its own")
+	default:
+	}
+}
+
+func TestICMPListenerDispatchWrongID(t *testing.T) {
+	l := &icmpListener{
+		replyType: ipv4.ICMPTypeEchoReply,
+		pending:   map[icmpPendingKey]icmpPending{},
+	}
+	peer := &net.IPAddr{IP: net.ParseIP("192.0.2.1")}
+	ch := l.register(peer, 1, 7, true)
+
+	// A reply with the right (peer, seq) but the wrong echo ID must be
+	// ignored on a privileged socket, where the kernel doesn't rewrite
+	// the ID and a mismatch means it's not our request.
+	l.dispatch(&icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: 99, Seq: 7}}, peer, 64)
+
+	select {
+	case <-ch:
+		t.Error("dispatch delivered a reply with a mismatched echo ID")
+	default:
+	}
+}
+
+func TestICMPListenerDispatchUnregistered(t *testing.T) {
+	l := &icmpListener{
+		replyType: ipv4.ICMPTypeEchoReply,
+		pending:   map[icmpPendingKey]icmpPending{},
+	}
+	peer := &net.IPAddr{IP: net.ParseIP("192.0.2.1")}
+
+	// Dispatching with nothing registered must not panic and must leave
+	// mtuExceeded untouched.
+	l.dispatch(&icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: 1, Seq: 7}}, peer, 64)
+	if l.mtuExceeded != 0 {
+		t.Error("dispatch set mtuExceeded for an ordinary echo reply")
+	}
+}
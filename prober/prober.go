@@ -0,0 +1,35 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"context"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/blackbox_exporter/config"
+)
+
+// ProbeFn probes target according to module, registering whatever
+// metrics it collects on registry, and reports whether the probe
+// succeeded.
+type ProbeFn func(ctx context.Context, target string, module config.Module, registry *prometheus.Registry, logger log.Logger) bool
+
+// Probers maps a module's `prober` config value to the function that
+// implements it.
+var Probers = map[string]ProbeFn{
+	"icmp":       ProbeICMP,
+	"traceroute": ProbeTraceroute,
+}
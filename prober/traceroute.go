@@ -0,0 +1,301 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"github.com/prometheus/blackbox_exporter/config"
+)
+
+// minPathMTUProbeSize/maxPathMTUProbeSize bound the binary search used to
+// discover the path MTU with the DF bit set.
+const (
+	minPathMTUProbeSize = 1200
+	maxPathMTUProbeSize = 9000
+)
+
+// tracerouteReplyKind distinguishes the three kinds of ICMP response
+// awaitTracerouteReply can match.
+type tracerouteReplyKind int
+
+const (
+	tracerouteHop tracerouteReplyKind = iota
+	tracerouteReached
+	tracerouteTooBig
+)
+
+// ProbeTraceroute sends successive echo requests with increasing IP
+// TTL/HopLimit, recording the address and RTT of whichever hop replies
+// (either with a TimeExceeded en route, or an EchoReply from the target
+// itself), and separately searches for the largest DF-set payload that
+// doesn't trigger fragmentation, to expose path MTU black-holes.
+func ProbeTraceroute(ctx context.Context, target string, module config.Module, registry *prometheus.Registry, logger log.Logger) (success bool) {
+	var (
+		hopsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_traceroute_hops",
+			Help: "Number of hops observed to the target",
+		})
+		pathMTUGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_traceroute_path_mtu_bytes",
+			Help: "Largest payload, with the don't-fragment bit set, that reached the target without fragmentation",
+		})
+		hopRTTGaugeVec = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "probe_traceroute_hop_rtt_seconds",
+			Help: "Round-trip time to each hop along the path",
+		}, []string{"hop", "addr"})
+	)
+	registry.MustRegister(hopsGauge)
+	registry.MustRegister(pathMTUGauge)
+	registry.MustRegister(hopRTTGaugeVec)
+
+	timeoutDeadline, _ := ctx.Deadline()
+	deadline := time.Now().Add(timeoutDeadline.Sub(time.Now()))
+
+	ip, err := chooseProtocol(module.Traceroute.PreferredIPProtocol, target, registry, logger)
+	if err != nil {
+		level.Warn(logger).Log("msg", "Error resolving address", "err", err)
+		return false
+	}
+	v6 := ip.IP.To4() == nil
+
+	var (
+		requestType, replyType, timeExceededType icmp.Type
+		network                                  string
+	)
+	if v6 {
+		requestType = ipv6.ICMPTypeEchoRequest
+		replyType = ipv6.ICMPTypeEchoReply
+		timeExceededType = ipv6.ICMPTypeTimeExceeded
+		network = "ip6:ipv6-icmp"
+	} else {
+		requestType = ipv4.ICMPTypeEcho
+		replyType = ipv4.ICMPTypeEchoReply
+		timeExceededType = ipv4.ICMPTypeTimeExceeded
+		network = "ip4:icmp"
+	}
+
+	socket, err := listenICMP(network, v6)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error listening to socket", "err", err)
+		return false
+	}
+	defer socket.Close()
+
+	maxHops := module.Traceroute.MaxHops
+	if maxHops < 1 {
+		maxHops = 30
+	}
+
+	id := os.Getpid() & 0xffff
+	reachedTarget := false
+
+	for ttl := 1; ttl <= maxHops && time.Now().Before(deadline); ttl++ {
+		if v6 {
+			err = socket.IPv6PacketConn().SetHopLimit(ttl)
+		} else {
+			err = socket.IPv4PacketConn().SetTTL(ttl)
+		}
+		if err != nil {
+			level.Error(logger).Log("msg", "Error setting TTL/HopLimit", "ttl", ttl, "err", err)
+			return false
+		}
+
+		seq := int(getICMPSequence())
+		wm := icmp.Message{
+			Type: requestType,
+			Code: 0,
+			Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("Prometheus Blackbox Exporter")},
+		}
+		wb, err := wm.Marshal(nil)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error marshalling packet", "err", err)
+			return false
+		}
+
+		sent := time.Now()
+		if _, err = socket.WriteTo(wb, ip); err != nil {
+			level.Warn(logger).Log("msg", "Error writing to socket", "ttl", ttl, "err", err)
+			continue
+		}
+
+		hopAddr, kind, ok := awaitTracerouteReply(socket, ip, id, seq, v6, replyType, timeExceededType, deadline, logger)
+		if !ok {
+			level.Warn(logger).Log("msg", "No reply for hop", "ttl", ttl)
+			continue
+		}
+
+		hopsGauge.Set(float64(ttl))
+		hopRTTGaugeVec.WithLabelValues(strconv.Itoa(ttl), hopAddr).Set(time.Since(sent).Seconds())
+
+		if kind == tracerouteReached {
+			reachedTarget = true
+			break
+		}
+	}
+
+	if reachedTarget {
+		if err := setDontFragment(socket, v6); err != nil {
+			level.Warn(logger).Log("msg", "Error setting don't-fragment bit for path MTU discovery", "err", err)
+		} else {
+			pathMTUGauge.Set(float64(discoverPathMTU(socket, ip, id, v6, requestType, replyType, timeExceededType, deadline, logger)))
+		}
+	}
+
+	return reachedTarget
+}
+
+// awaitTracerouteReply waits for a reply to the probe (id, seq) just
+// sent: an EchoReply from the target, a TimeExceeded from an
+// intermediate hop whose quoted original datagram matches our (id,
+// seq), or a fragmentation-needed/PacketTooBig response. EchoReplies
+// from any address other than the target, and TimeExceeded messages
+// that don't quote our own probe, are ignored so that concurrent
+// traceroutes sharing a raw socket don't cross-attribute each other's
+// hops. Fragmentation-needed/PacketTooBig responses are accepted from
+// any address without checking which probe they quote.
+func awaitTracerouteReply(socket *icmpConn, ip *net.IPAddr, id, seq int, v6 bool, replyType, timeExceededType icmp.Type, deadline time.Time, logger log.Logger) (addr string, kind tracerouteReplyKind, ok bool) {
+	if err := socket.SetReadDeadline(deadline); err != nil {
+		level.Error(logger).Log("msg", "Error setting socket deadline", "err", err)
+		return "", 0, false
+	}
+
+	proto := protocolICMP
+	if v6 {
+		proto = protocolIPv6ICMP
+	}
+
+	rb := make([]byte, 1500)
+	for {
+		n, peer, err := socket.ReadFrom(rb)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				return "", 0, false
+			}
+			level.Error(logger).Log("msg", "Error reading from socket", "err", err)
+			continue
+		}
+
+		rm, err := icmp.ParseMessage(proto, rb[:n])
+		if err != nil {
+			level.Warn(logger).Log("msg", "Error parsing ICMP message", "err", err)
+			continue
+		}
+
+		if _, isTooBig := packetTooBigMTU(rm); isTooBig {
+			return peer.String(), tracerouteTooBig, true
+		}
+
+		switch rm.Type {
+		case replyType:
+			echo, ok := rm.Body.(*icmp.Echo)
+			if !ok || peer.String() != ip.String() || echo.ID != id || echo.Seq != seq {
+				continue
+			}
+			return peer.String(), tracerouteReached, true
+		case timeExceededType:
+			te, ok := rm.Body.(*icmp.TimeExceeded)
+			if !ok {
+				continue
+			}
+			qid, qseq, ok := decodeQuotedEcho(te.Data, v6)
+			if !ok || qid != id || qseq != seq {
+				continue
+			}
+			return peer.String(), tracerouteHop, true
+		default:
+			continue
+		}
+	}
+}
+
+// decodeQuotedEcho extracts the ID and sequence number of the echo
+// request quoted inside a TimeExceeded (or other ICMP error) payload, so
+// replies can be attributed to the probe that caused them rather than
+// accepted on trust. IPv6 intermediate headers beyond the fixed 40-byte
+// IPv6 header are not walked; routers overwhelmingly quote a bare echo
+// request with no extension headers.
+func decodeQuotedEcho(data []byte, v6 bool) (id, seq int, ok bool) {
+	if v6 {
+		if len(data) < 40+8 {
+			return 0, 0, false
+		}
+		data = data[40:]
+	} else {
+		if len(data) < 1 {
+			return 0, 0, false
+		}
+		ihl := int(data[0]&0x0f) * 4
+		if ihl < 20 || len(data) < ihl+8 {
+			return 0, 0, false
+		}
+		data = data[ihl:]
+	}
+
+	// Quoted ICMP echo header: type(1) code(1) checksum(2) id(2) seq(2).
+	id = int(data[4])<<8 | int(data[5])
+	seq = int(data[6])<<8 | int(data[7])
+	return id, seq, true
+}
+
+// discoverPathMTU binary-searches for the largest DF-set payload size
+// that reaches the target as an EchoReply rather than triggering a
+// PacketTooBig/fragmentation-needed response. The caller must already
+// have set the don't-fragment bit on socket.
+func discoverPathMTU(socket *icmpConn, ip *net.IPAddr, id int, v6 bool, requestType, replyType, timeExceededType icmp.Type, deadline time.Time, logger log.Logger) int {
+	lo, hi := minPathMTUProbeSize, maxPathMTUProbeSize
+	best := 0
+
+	for lo <= hi {
+		size := (lo + hi) / 2
+		seq := int(getICMPSequence())
+		wm := icmp.Message{
+			Type: requestType,
+			Code: 0,
+			Body: &icmp.Echo{ID: id, Seq: seq, Data: make([]byte, size)},
+		}
+		wb, err := wm.Marshal(nil)
+		if err != nil {
+			level.Warn(logger).Log("msg", "Error marshalling MTU probe", "err", err)
+			return best
+		}
+		if _, err := socket.WriteTo(wb, ip); err != nil {
+			// EMSGSIZE (or an equivalent local rejection) means this size
+			// already doesn't fit; shrink the search window.
+			hi = size - 1
+			continue
+		}
+
+		_, kind, ok := awaitTracerouteReply(socket, ip, id, seq, v6, replyType, timeExceededType, deadline, logger)
+		if ok && kind == tracerouteReached {
+			best = size
+			lo = size + 1
+		} else {
+			hi = size - 1
+		}
+	}
+
+	return best
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import "testing"
+
+func TestDecodeQuotedEchoIPv4(t *testing.T) {
+	// A bare 20-byte IPv4 header (IHL=5) followed by an 8-byte ICMP echo
+	// header quoting id=0x0102, seq=0x0304.
+	data := make([]byte, 20+8)
+	data[0] = 0x45 // version 4, IHL 5
+	quoted := data[20:]
+	quoted[0] = 8 // echo request type, irrelevant to decodeQuotedEcho
+	quoted[4] = 0x01
+	quoted[5] = 0x02
+	quoted[6] = 0x03
+	quoted[7] = 0x04
+
+	id, seq, ok := decodeQuotedEcho(data, false)
+	if !ok {
+		t.Fatal("decodeQuotedEcho() ok = false, want true")
+	}
+	if id != 0x0102 || seq != 0x0304 {
+		t.Errorf("decodeQuotedEcho() = (%d, %d), want (%d, %d)", id, seq, 0x0102, 0x0304)
+	}
+}
+
+func TestDecodeQuotedEchoIPv4Short(t *testing.T) {
+	// Too short to contain even the IPv4 header.
+	if _, _, ok := decodeQuotedEcho([]byte{0x45, 0x00}, false); ok {
+		t.Error("decodeQuotedEcho() ok = true for truncated IPv4 header, want false")
+	}
+}
+
+func TestDecodeQuotedEchoIPv4TruncatedEcho(t *testing.T) {
+	// A valid 20-byte IPv4 header but no room for the quoted ICMP header.
+	data := make([]byte, 20+4)
+	data[0] = 0x45
+	if _, _, ok := decodeQuotedEcho(data, false); ok {
+		t.Error("decodeQuotedEcho() ok = true for truncated quoted echo header, want false")
+	}
+}
+
+func TestDecodeQuotedEchoIPv4BadIHL(t *testing.T) {
+	// IHL of 0 is below the minimum valid header length (5 words/20 bytes).
+	data := make([]byte, 20+8)
+	data[0] = 0x40
+	if _, _, ok := decodeQuotedEcho(data, false); ok {
+		t.Error("decodeQuotedEcho() ok = true for invalid IHL, want false")
+	}
+}
+
+func TestDecodeQuotedEchoIPv6(t *testing.T) {
+	// A fixed 40-byte IPv6 header followed by an 8-byte ICMP echo header
+	// quoting id=0x0506, seq=0x0708.
+	data := make([]byte, 40+8)
+	quoted := data[40:]
+	quoted[0] = 128 // ICMPv6 echo request type, irrelevant to decodeQuotedEcho
+	quoted[4] = 0x05
+	quoted[5] = 0x06
+	quoted[6] = 0x07
+	quoted[7] = 0x08
+
+	id, seq, ok := decodeQuotedEcho(data, true)
+	if !ok {
+		t.Fatal("decodeQuotedEcho() ok = false, want true")
+	}
+	if id != 0x0506 || seq != 0x0708 {
+		t.Errorf("decodeQuotedEcho() = (%d, %d), want (%d, %d)", id, seq, 0x0506, 0x0708)
+	}
+}
+
+func TestDecodeQuotedEchoIPv6Short(t *testing.T) {
+	// Too short to contain the fixed IPv6 header plus a quoted echo header.
+	data := make([]byte, 40)
+	if _, _, ok := decodeQuotedEcho(data, true); ok {
+		t.Error("decodeQuotedEcho() ok = true for truncated IPv6 data, want false")
+	}
+}